@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// b2Backend is a StorageBackend backed by a Backblaze B2 bucket, wired up
+// through the --storage-type=b2 flag alongside --bucket and the
+// B2_ACCOUNT_ID / B2_APPLICATION_KEY environment variables.
+type b2Backend struct {
+	bucket *b2.Bucket
+}
+
+func newB2Backend(bucketName string) (*b2Backend, error) {
+	ctx := context.Background()
+	client, err := b2.NewClient(ctx, os.Getenv("B2_ACCOUNT_ID"), os.Getenv("B2_APPLICATION_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := client.Bucket(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &b2Backend{bucket: bucket}, nil
+}
+
+// key turns a StorageBackend-style relative path into a B2 object name,
+// collapsing the "." that Walk(".", ...) passes for "the whole bucket"
+// down to an empty prefix rather than a literal no-match ".".
+func (b *b2Backend) key(path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if path == "." {
+		return ""
+	}
+	return path
+}
+
+func (b *b2Backend) Open(path string) (io.ReadCloser, error) {
+	return b.bucket.Object(b.key(path)).NewReader(context.Background()), nil
+}
+
+func (b *b2Backend) Create(path string) (io.WriteCloser, error) {
+	return b.bucket.Object(b.key(path)).NewWriter(context.Background()), nil
+}
+
+func (b *b2Backend) Stat(path string) (os.FileInfo, error) {
+	attrs, err := b.bucket.Object(b.key(path)).Attrs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return newObjectFileInfo(filepath.Base(path), attrs.Size, attrs.UploadTimestamp, false), nil
+}
+
+func (b *b2Backend) ReadDir(path string) ([]os.FileInfo, error) {
+	prefix := b.key(path)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ctx := context.Background()
+	iter := b.bucket.List(ctx, b2.ListPrefix(prefix), b2.ListDelimiter("/"))
+	infos := make([]os.FileInfo, 0)
+	for iter.Next() {
+		obj := iter.Object()
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(obj.Name(), prefix)
+		if name == "" {
+			continue
+		}
+		infos = append(infos, newObjectFileInfo(name, attrs.Size, attrs.UploadTimestamp, strings.HasSuffix(obj.Name(), "/")))
+	}
+	return infos, iter.Err()
+}
+
+func (b *b2Backend) Remove(path string) error {
+	return b.bucket.Object(b.key(path)).Delete(context.Background())
+}
+
+func (b *b2Backend) Rename(oldpath, newpath string) error {
+	ctx := context.Background()
+	src := b.bucket.Object(b.key(oldpath))
+	dst := b.bucket.Object(b.key(newpath))
+	if _, err := dst.NewWriter(ctx).ReadFrom(src.NewReader(ctx)); err != nil {
+		return err
+	}
+	return src.Delete(ctx)
+}
+
+func (b *b2Backend) Walk(root string, walkFn filepath.WalkFunc) error {
+	ctx := context.Background()
+	iter := b.bucket.List(ctx, b2.ListPrefix(b.key(root)))
+	for iter.Next() {
+		obj := iter.Object()
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			if walkErr := walkFn(obj.Name(), nil, err); walkErr != nil {
+				return walkErr
+			}
+			continue
+		}
+		info := newObjectFileInfo(filepath.Base(obj.Name()), attrs.Size, attrs.UploadTimestamp, false)
+		if err := walkFn(obj.Name(), info, nil); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// chunkState is the small sidecar JSON written next to a .partial upload,
+// recording enough to resume after a dropped connection.
+type chunkState struct {
+	ID       string    `json:"id"`
+	DestPath string    `json:"dest_path"`
+	Filename string    `json:"filename"`
+	Total    int64     `json:"total"`
+	Offset   int64     `json:"offset"`
+	Updated  time.Time `json:"updated"`
+}
+
+const (
+	partialSuffix      = ".partial"
+	partialStateSuffix = ".partial.json"
+	// partialMaxAge is how long an abandoned .partial/.partial.json pair is
+	// kept before the GC sweep (run on the same cadence as makeIndex)
+	// removes it.
+	partialMaxAge = 24 * time.Hour
+)
+
+func partialPath(id string) string      { return filepath.Join(".uploads", id+partialSuffix) }
+func partialStatePath(id string) string { return filepath.Join(".uploads", id+partialStateSuffix) }
+
+// parseUploadMetadata decodes the tus.io `Upload-Metadata` header, a
+// comma-separated list of `key base64(value)` pairs, returning the decoded
+// values keyed by name.
+func parseUploadMetadata(header string) map[string]string {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		out[parts[0]] = string(decoded)
+	}
+	return out
+}
+
+// hUploadChunkHead answers offset-discovery requests: HEAD /-/upload/{id}
+// returns the number of bytes already received via Upload-Offset, so the
+// client knows where to resume a Content-Range upload.
+func (s *HTTPStaticServer) hUploadChunkHead(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	state, err := s.readChunkState(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(state.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(state.Total, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hUploadChunk handles POST (create) and PATCH (append) requests for a
+// chunked/resumable upload, tus.io-style: the body carries one
+// Content-Range: bytes X-Y/Z slice, which is appended to a .partial sidecar
+// file. Once offset reaches the declared total, the partial is atomically
+// renamed to its final destination.
+func (s *HTTPStaticServer) hUploadChunk(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !s.localFSOnly() {
+		http.Error(w, "Chunked upload requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
+
+	var state *chunkState
+	var err error
+	if r.Method == "POST" {
+		meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		destPath := meta["path"]
+		filename := meta["filename"]
+
+		if !s.withinRoot(filepath.Join(destPath, filename)) {
+			http.Error(w, "Invalid upload path", http.StatusBadRequest)
+			return
+		}
+
+		auth := s.readAccessConf(destPath)
+		if !auth.canUpload(r) {
+			http.Error(w, "Upload forbidden", http.StatusForbidden)
+			return
+		}
+
+		total, _ := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		state = &chunkState{ID: id, DestPath: destPath, Filename: filename, Total: total}
+	} else {
+		state, err = s.readChunkState(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		auth := s.readAccessConf(state.DestPath)
+		if !auth.canUpload(r) {
+			http.Error(w, "Upload forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, "Invalid Content-Range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if start != state.Offset {
+		http.Error(w, fmt.Sprintf("Offset mismatch: have %d, got %d", state.Offset, start), http.StatusConflict)
+		return
+	}
+	if total > 0 {
+		state.Total = total
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.Root, ".uploads"), 0755); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(s.Root, partialPath(id)), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	state.Offset = start + n
+	state.Updated = chunkNow()
+	_ = end // parsed but not checked against the body length
+
+	if state.Total > 0 && state.Offset >= state.Total {
+		if err := s.finishChunkUpload(state); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if err := s.writeChunkState(state); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(state.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishChunkUpload renames a completed .partial to its destination and
+// drops the sidecar state file.
+func (s *HTTPStaticServer) finishChunkUpload(state *chunkState) error {
+	dest := filepath.Join(state.DestPath, state.Filename)
+	if !s.withinRoot(dest) {
+		return fmt.Errorf("invalid upload path: %q", dest)
+	}
+	if err := os.Rename(filepath.Join(s.Root, partialPath(state.ID)), filepath.Join(s.Root, dest)); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(s.Root, partialStatePath(state.ID)))
+	return nil
+}
+
+// withinRoot reports whether joining relPath onto s.Root keeps the result
+// inside s.Root, rejecting "../" traversal smuggled in through
+// client-controlled path components such as the tus Upload-Metadata header.
+func (s *HTTPStaticServer) withinRoot(relPath string) bool {
+	root := filepath.Clean(s.Root)
+	abs := filepath.Clean(filepath.Join(root, relPath))
+	return abs == root || strings.HasPrefix(abs, root+string(filepath.Separator))
+}
+
+func (s *HTTPStaticServer) readChunkState(id string) (*chunkState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Root, partialStatePath(id)))
+	if err != nil {
+		return nil, err
+	}
+	state := &chunkState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *HTTPStaticServer) writeChunkState(state *chunkState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Root, partialStatePath(state.ID)), data, 0644)
+}
+
+// gcPartialUploads removes .partial/.partial.json pairs whose state file was
+// last touched more than partialMaxAge ago. Run from the same background
+// loop that rebuilds the search index.
+func (s *HTTPStaticServer) gcPartialUploads() {
+	uploadsDir := filepath.Join(s.Root, ".uploads")
+	entries, err := ioutil.ReadDir(uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), partialStateSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), partialStateSuffix)
+		state, err := s.readChunkState(id)
+		if err != nil {
+			continue
+		}
+		if chunkNow().Sub(state.Updated) > partialMaxAge {
+			os.Remove(filepath.Join(uploadsDir, id+partialSuffix))
+			os.Remove(filepath.Join(uploadsDir, entry.Name()))
+		}
+	}
+}
+
+// parseContentRange parses a "bytes X-Y/Z" Content-Range header as used by
+// tus.io-style chunked uploads.
+func parseContentRange(header string) (start, end, total int64, err error) {
+	header = strings.TrimPrefix(header, "bytes ")
+	parts := strings.SplitN(header, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range: %q", header)
+	}
+	total, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil && parts[1] != "*" {
+		return 0, 0, 0, err
+	}
+	rangeParts := strings.SplitN(parts[0], "-", 2)
+	if len(rangeParts) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range: %q", header)
+	}
+	if start, err = strconv.ParseInt(rangeParts[0], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = strconv.ParseInt(rangeParts[1], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	return start, end, total, nil
+}
+
+// chunkNow is time.Now, split out so tests can stub it.
+var chunkNow = time.Now
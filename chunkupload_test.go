@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestWithinRoot(t *testing.T) {
+	s := &HTTPStaticServer{Root: "/srv/data/"}
+
+	cases := []struct {
+		relPath string
+		want    bool
+	}{
+		{"foo/bar.txt", true},
+		{"", true},
+		{"../etc/passwd", false},
+		{"foo/../../etc/passwd", false},
+		{"foo/../bar.txt", true},
+	}
+	for _, c := range cases {
+		if got := s.withinRoot(c.relPath); got != c.want {
+			t.Errorf("withinRoot(%q) = %v, want %v", c.relPath, got, c.want)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, total, err := parseContentRange("bytes 0-99/200")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if start != 0 || end != 99 || total != 200 {
+		t.Fatalf("got (%d, %d, %d), want (0, 99, 200)", start, end, total)
+	}
+
+	if _, _, _, err := parseContentRange("garbage"); err == nil {
+		t.Fatal("expected error for malformed Content-Range, got nil")
+	}
+
+	if _, _, _, err := parseContentRange("bytes 0-99"); err == nil {
+		t.Fatal("expected error for missing total, got nil")
+	}
+}
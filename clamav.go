@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clamdStream is an io.Writer that forwards every write to a clamd INSTREAM
+// session, chunked per the ClamAV stream protocol: each chunk is a 4-byte
+// big-endian length prefix followed by the chunk bytes, terminated by a
+// zero-length chunk. scanUpload tees the quarantine-file write through one
+// of these, so scanning costs no extra read pass over the file.
+type clamdStream struct {
+	conn net.Conn
+	err  error
+}
+
+// dialClamd opens an INSTREAM session against addr, e.g.
+// "tcp://localhost:3310" or "unix:///var/run/clamav/clamd.sock", set via
+// the --virustotal-clamd flag.
+func dialClamd(addr string) (*clamdStream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	network, target := u.Scheme, u.Host
+	if network == "unix" {
+		target = u.Path
+	}
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &clamdStream{conn: conn}, nil
+}
+
+func (c *clamdStream) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(p)))
+	if _, err := c.conn.Write(size[:]); err != nil {
+		c.err = err
+		return 0, err
+	}
+	if _, err := c.conn.Write(p); err != nil {
+		c.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Verdict sends the zero-length chunk that ends the INSTREAM session and
+// reads clamd's single response line, e.g. "stream: OK" or
+// "stream: Eicar-Test-Signature FOUND". It closes the connection either way.
+func (c *clamdStream) Verdict() (infected bool, signature string, err error) {
+	defer c.conn.Close()
+	if c.err != nil {
+		return false, "", c.err
+	}
+	if _, err := c.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, "", err
+	}
+	// zINSTREAM is a 'z'-prefixed command, so its reply is NUL-terminated
+	// like the request, not newline-terminated.
+	line, err := bufio.NewReader(c.conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return false, "", err
+	}
+	line = strings.TrimSpace(strings.TrimSuffix(line, "\x00"))
+	if !strings.HasSuffix(line, "FOUND") {
+		return false, "", nil
+	}
+	signature = strings.TrimSuffix(line, "FOUND")
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "stream:")
+	return true, strings.TrimSpace(signature), nil
+}
+
+// scanQuarantineDir holds upload bytes in flight through a clamd scan. It
+// lies under s.Root, so like any other path there it is reachable through
+// hIndex/hJSONList while a scan runs; the upload's destination path is not
+// written until scanUpload returns a clean copy.
+const scanQuarantineDir = ".ghs-scan-tmp"
+
+// infectedUploadError is returned by scanUpload when clamd flags the
+// content; hUpload maps it to a 422 response carrying the signature name.
+type infectedUploadError struct {
+	signature string
+}
+
+func (e *infectedUploadError) Error() string {
+	return "infected: " + e.signature
+}
+
+// scanUpload streams src into a quarantine temp file under s.Root, teeing
+// it through a clamd INSTREAM session as it writes, and only after a clean
+// verdict unlinks the temp file's directory entry and returns the still-open
+// file rewound to the start for the caller to copy into the real
+// destination. Nothing is written at the upload's destination path until
+// that verdict is in, and on an infected verdict or a scan error the temp
+// file is removed before returning. On an infected verdict it returns
+// *infectedUploadError.
+func (s *HTTPStaticServer) scanUpload(src io.Reader) (*os.File, error) {
+	dir := filepath.Join(s.Root, scanQuarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(dir, "scan-")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmpPath)
+	}
+
+	clam, err := dialClamd(s.ClamdAddr)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := io.Copy(io.MultiWriter(tmp, clam), src); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	infected, signature, err := clam.Verdict()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if infected {
+		cleanup()
+		return nil, &infectedUploadError{signature: signature}
+	}
+
+	if err := os.Remove(tmpPath); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// scanVerdict is the sidecar hUpload writes next to a clean upload so
+// hJSONList can surface a scanned/infected badge without re-dialing clamd.
+// Infected uploads are rejected and removed instead of being left behind
+// with a sidecar of their own.
+type scanVerdict struct {
+	Infected  bool      `json:"infected"`
+	Signature string    `json:"signature,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+const scanSuffix = ".ghs.scan.json"
+
+func scanVerdictPath(filePath string) string {
+	return filePath + scanSuffix
+}
+
+func (s *HTTPStaticServer) writeScanVerdict(filePath string, v *scanVerdict) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Root, scanVerdictPath(filePath)), data, 0644)
+}
+
+func (s *HTTPStaticServer) readScanVerdict(filePath string) (*scanVerdict, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Root, scanVerdictPath(filePath)))
+	if err != nil {
+		return nil, err
+	}
+	v := &scanVerdict{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
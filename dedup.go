@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// blobDir is where deduplicated content lives, sharded two levels deep by
+// the first 4 hex chars of its SHA-256 so no directory holds too many
+// entries: <root>/.ghs-blobs/<aa>/<bb>/<full-hash>.
+const blobDir = ".ghs-blobs"
+
+// pointerSuffix marks a small JSON pointer file left at the requested path
+// on filesystems where hardlinks aren't available; it just names the blob
+// hash to resolve to.
+const pointerSuffix = ".ghs-blob-ptr"
+
+type blobRefcount struct {
+	Count int `json:"count"`
+}
+
+type blobPointer struct {
+	Hash string `json:"hash"`
+}
+
+func blobPath(root, hash string) string {
+	return filepath.Join(root, blobDir, hash[0:2], hash[2:4], hash)
+}
+
+func blobRefcountPath(root, hash string) string {
+	return blobPath(root, hash) + ".refcount.json"
+}
+
+// writeDedupBlob streams src through sha256 into a temp file in the blob
+// store's top-level directory, then either links it in as the final blob (first
+// time this content is seen) or discards the temp copy and bumps the
+// existing blob's refcount (repeated upload of the same bytes). It returns
+// the content hash so the caller can point destPath at the blob.
+func (s *HTTPStaticServer) writeDedupBlob(src io.Reader) (hash string, err error) {
+	if err := os.MkdirAll(filepath.Join(s.Root, blobDir), 0755); err != nil {
+		return "", err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Join(s.Root, blobDir), "upload-")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, h), src); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	tmpFile.Close()
+	hash = hex.EncodeToString(h.Sum(nil))
+
+	dst := blobPath(s.Root, hash)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	// The existence check, rename and refcount write have to happen as one
+	// atomic step: two concurrent uploads of identical content (the exact
+	// scenario dedup exists for) could otherwise both observe "blob
+	// doesn't exist yet" and each write refcount=1, instead of one writing
+	// 1 and the other bumping it to 2 — leaving the count one short of the
+	// number of live references once both finish.
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	if _, statErr := os.Stat(dst); os.IsNotExist(statErr) {
+		if err := os.Rename(tmpPath, dst); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+		if err := s.writeBlobRefcount(hash, 1); err != nil {
+			return "", err
+		}
+	} else {
+		os.Remove(tmpPath)
+		if err := s.bumpBlobRefcount(hash, 1); err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
+
+// linkToBlob points destPath at hash's blob: a hard link where the
+// filesystem supports it, otherwise a small pointer file that hIndex's
+// resolveBlob follows when serving.
+func (s *HTTPStaticServer) linkToBlob(destPath, hash string) error {
+	absDest := filepath.Join(s.Root, destPath)
+	if err := os.MkdirAll(filepath.Dir(absDest), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(blobPath(s.Root, hash), absDest); err == nil {
+		return nil
+	}
+	return s.writeBlobPointer(destPath, hash)
+}
+
+func (s *HTTPStaticServer) writeBlobPointer(destPath, hash string) error {
+	data, err := json.Marshal(blobPointer{Hash: hash})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Root, destPath+pointerSuffix), data, 0644)
+}
+
+// resolveBlob follows a pointer file at path, if one exists, returning the
+// absolute path to the underlying blob. If path isn't a pointer, it returns
+// path's own absolute form unchanged.
+func (s *HTTPStaticServer) resolveBlob(path string) string {
+	ptrPath := filepath.Join(s.Root, path+pointerSuffix)
+	data, err := ioutil.ReadFile(ptrPath)
+	if err != nil {
+		return filepath.Join(s.Root, path)
+	}
+	var ptr blobPointer
+	if err := json.Unmarshal(data, &ptr); err != nil {
+		return filepath.Join(s.Root, path)
+	}
+	return blobPath(s.Root, ptr.Hash)
+}
+
+func (s *HTTPStaticServer) readBlobRefcount(hash string) (int, error) {
+	data, err := ioutil.ReadFile(blobRefcountPath(s.Root, hash))
+	if err != nil {
+		return 0, err
+	}
+	var rc blobRefcount
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return 0, err
+	}
+	return rc.Count, nil
+}
+
+func (s *HTTPStaticServer) writeBlobRefcount(hash string, count int) error {
+	data, err := json.Marshal(blobRefcount{Count: count})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(blobRefcountPath(s.Root, hash), data, 0644)
+}
+
+// bumpBlobRefcount must only be called with s.dedupMu held, so its
+// read-modify-write of the refcount sidecar can't race another uploader's
+// or deleter's view of the same hash (see writeDedupBlob and releaseBlob).
+func (s *HTTPStaticServer) bumpBlobRefcount(hash string, delta int) error {
+	count, err := s.readBlobRefcount(hash)
+	if err != nil {
+		count = 0
+	}
+	count += delta
+	return s.writeBlobRefcount(hash, count)
+}
+
+// unlinkBlob removes path's pointer file (if any) and its own directory
+// entry, then releases the underlying blob's refcount. It is the hDelete
+// counterpart to linkToBlob.
+func (s *HTTPStaticServer) unlinkBlob(path string) error {
+	ptrPath := filepath.Join(s.Root, path+pointerSuffix)
+	data, err := ioutil.ReadFile(ptrPath)
+	if err == nil {
+		var ptr blobPointer
+		if err := json.Unmarshal(data, &ptr); err != nil {
+			return err
+		}
+		if err := os.Remove(ptrPath); err != nil {
+			return err
+		}
+		return s.releaseBlob(ptr.Hash)
+	}
+
+	absDest := filepath.Join(s.Root, path)
+	hash, err := hashFromBlobLink(absDest)
+	if err != nil {
+		return os.Remove(absDest)
+	}
+	if err := os.Remove(absDest); err != nil {
+		return err
+	}
+	return s.releaseBlob(hash)
+}
+
+// hashFromBlobLink recovers the content hash of a hard-linked blob by
+// reading and re-hashing it; the link itself carries no metadata.
+func hashFromBlobLink(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// releaseBlob decrements hash's refcount and, once it reaches zero, removes
+// the underlying blob and its refcount sidecar. Called from hDelete when
+// removing a path that resolves to a dedup pointer. It takes s.dedupMu so
+// its read-decrement-write can't race a concurrent writeDedupBlob (or
+// another releaseBlob) observing and acting on the same stale count.
+func (s *HTTPStaticServer) releaseBlob(hash string) error {
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	count, err := s.readBlobRefcount(hash)
+	if err != nil {
+		return err
+	}
+	count--
+	if count <= 0 {
+		os.Remove(blobPath(s.Root, hash))
+		os.Remove(blobRefcountPath(s.Root, hash))
+		return nil
+	}
+	return s.writeBlobRefcount(hash, count)
+}
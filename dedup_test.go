@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteDedupBlobRefcounting(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghs-dedup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &HTTPStaticServer{Root: root}
+
+	hash1, err := s.writeDedupBlob(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	count, err := s.readBlobRefcount(hash1)
+	if err != nil {
+		t.Fatalf("read refcount: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("refcount after first write = %d, want 1", count)
+	}
+
+	// a second upload of identical content must bump the existing blob's
+	// refcount rather than create a duplicate.
+	hash2, err := s.writeDedupBlob(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("second write: %v", err)
+	}
+	if hash1 != hash2 {
+		t.Fatalf("hashes differ for identical content: %q vs %q", hash1, hash2)
+	}
+	count, err = s.readBlobRefcount(hash1)
+	if err != nil {
+		t.Fatalf("read refcount: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("refcount after second write = %d, want 2", count)
+	}
+
+	// releasing one reference should leave the blob (and the other
+	// reference) intact.
+	if err := s.releaseBlob(hash1); err != nil {
+		t.Fatalf("releaseBlob: %v", err)
+	}
+	count, err = s.readBlobRefcount(hash1)
+	if err != nil {
+		t.Fatalf("read refcount after release: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("refcount after one release = %d, want 1", count)
+	}
+	if _, err := os.Stat(blobPath(root, hash1)); err != nil {
+		t.Fatalf("blob removed too early: %v", err)
+	}
+
+	// releasing the last reference removes the blob and its sidecar.
+	if err := s.releaseBlob(hash1); err != nil {
+		t.Fatalf("releaseBlob: %v", err)
+	}
+	if _, err := os.Stat(blobPath(root, hash1)); !os.IsNotExist(err) {
+		t.Fatalf("blob still present after last release: err=%v", err)
+	}
+	if _, err := os.Stat(blobRefcountPath(root, hash1)); !os.IsNotExist(err) {
+		t.Fatalf("refcount sidecar still present after last release: err=%v", err)
+	}
+}
+
+func TestWriteDedupBlobConcurrent(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghs-dedup-concurrent-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &HTTPStaticServer{Root: root}
+
+	const uploaders = 8
+	done := make(chan string, uploaders)
+	for i := 0; i < uploaders; i++ {
+		go func() {
+			hash, err := s.writeDedupBlob(strings.NewReader("same content"))
+			if err != nil {
+				t.Error(err)
+				done <- ""
+				return
+			}
+			done <- hash
+		}()
+	}
+
+	var hash string
+	for i := 0; i < uploaders; i++ {
+		h := <-done
+		if hash == "" {
+			hash = h
+		} else if h != "" && h != hash {
+			t.Fatalf("got differing hashes for identical content: %q vs %q", hash, h)
+		}
+	}
+
+	count, err := s.readBlobRefcount(hash)
+	if err != nil {
+		t.Fatalf("read refcount: %v", err)
+	}
+	if count != uploaders {
+		t.Fatalf("refcount = %d, want %d (mutex should serialize concurrent uploads)", count, uploaders)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// uploadMeta is the optional sidecar written next to an upload when the
+// client supplies max-days, max-downloads or randomize-name form fields. It
+// tracks enough to expire the file, enforce one-time-download semantics and
+// authorize anonymous deletion via its DeleteKey.
+type uploadMeta struct {
+	ExpiresAt       time.Time `json:"expires_at"`
+	MaxDownloads    int       `json:"max_downloads"` // 0 means unlimited
+	RemainingDownloads int    `json:"remaining_downloads"`
+	SHA256          string    `json:"sha256"`
+	DeleteKey       string    `json:"delete_key"`
+}
+
+const metaSuffix = ".ghs.meta.json"
+
+func metaPath(filePath string) string {
+	return filePath + metaSuffix
+}
+
+// newDeleteKey returns a random 32-byte hex-encoded token handed back to the
+// uploader as delete_key, so they can later DELETE the file anonymously via
+// the X-Delete-Key header.
+func newDeleteKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *HTTPStaticServer) readUploadMeta(filePath string) (*uploadMeta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Root, metaPath(filePath)))
+	if err != nil {
+		return nil, err
+	}
+	meta := &uploadMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *HTTPStaticServer) writeUploadMeta(filePath string, meta *uploadMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Root, metaPath(filePath)), data, 0644)
+}
+
+func (s *HTTPStaticServer) removeUploadMeta(filePath string) {
+	os.Remove(filepath.Join(s.Root, metaPath(filePath)))
+}
+
+// isExpired reports whether filePath has an uploadMeta sidecar that has
+// passed its expiry or exhausted its download count; hIndex/hJSONList use
+// this to hide expired entries until the sweep goroutine removes them.
+func (s *HTTPStaticServer) isExpired(filePath string) bool {
+	meta, err := s.readUploadMeta(filePath)
+	if err != nil {
+		return false
+	}
+	if !meta.ExpiresAt.IsZero() && expireNow().After(meta.ExpiresAt) {
+		return true
+	}
+	if meta.MaxDownloads > 0 && meta.RemainingDownloads <= 0 {
+		return true
+	}
+	return false
+}
+
+// gcExpiredUploads sweeps s.Root for .ghs.meta.json sidecars and removes
+// both the file and its sidecar once expired. Run at the same cadence as
+// makeIndex.
+func (s *HTTPStaticServer) gcExpiredUploads() {
+	s.storage.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return nil
+		}
+		if filepath.Ext(path) != ".json" || len(path) < len(metaSuffix) {
+			return nil
+		}
+		if path[len(path)-len(metaSuffix):] != metaSuffix {
+			return nil
+		}
+		// path is already relative to the backend's own root (per the
+		// StorageBackend contract), so no further rebasing against s.Root
+		// is needed here.
+		relFile := path[:len(path)-len(metaSuffix)]
+		if s.isExpired(relFile) {
+			s.storage.Remove(relFile)
+			s.removeUploadMeta(relFile)
+		}
+		return nil
+	})
+}
+
+// registerUploadMeta parses the optional max-days/max-downloads/
+// randomize-name form fields and, if any were supplied, records an
+// uploadMeta sidecar for destPath carrying its expiry, remaining download
+// count, content hash and a fresh deletion token. It returns the token (or
+// "" if none of the three fields was supplied) — this must mirror hUpload's
+// three-way OR for switching to the JSON response shape, or a
+// randomize-name-only upload would get that shape with an empty delete_key.
+func (s *HTTPStaticServer) registerUploadMeta(req *http.Request, destPath string, sum [sha256.Size]byte) (string, error) {
+	maxDays := req.FormValue("max-days")
+	maxDownloads := req.FormValue("max-downloads")
+	randomizeName := req.FormValue("randomize-name") == "true"
+	if maxDays == "" && maxDownloads == "" && !randomizeName {
+		return "", nil
+	}
+	if !s.localFSOnly() {
+		return "", fmt.Errorf("max-days/max-downloads/randomize-name require a localfs storage backend (got --storage-type=%s)", s.StorageType)
+	}
+
+	meta := &uploadMeta{SHA256: hex.EncodeToString(sum[:])}
+	if maxDays != "" {
+		days, err := strconv.Atoi(maxDays)
+		if err != nil {
+			return "", err
+		}
+		meta.ExpiresAt = expireNow().Add(time.Duration(days) * 24 * time.Hour)
+	}
+	if maxDownloads != "" {
+		n, err := strconv.Atoi(maxDownloads)
+		if err != nil {
+			return "", err
+		}
+		meta.MaxDownloads = n
+		meta.RemainingDownloads = n
+	}
+	deleteKey, err := newDeleteKey()
+	if err != nil {
+		return "", err
+	}
+	meta.DeleteKey = deleteKey
+
+	if err := s.writeUploadMeta(destPath, meta); err != nil {
+		return "", err
+	}
+	return deleteKey, nil
+}
+
+// consumeDownload decrements a one-time/limited-download file's remaining
+// count; hIndex calls it for each GET just before opening the file to serve
+// it. Files with no uploadMeta are a no-op.
+func (s *HTTPStaticServer) consumeDownload(filePath string) {
+	meta, err := s.readUploadMeta(filePath)
+	if err != nil || meta.MaxDownloads <= 0 {
+		return
+	}
+	meta.RemainingDownloads--
+	s.writeUploadMeta(filePath, meta)
+}
+
+// expireNow is time.Now, split out so tests can stub it.
+var expireNow = time.Now
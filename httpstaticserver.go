@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,6 +17,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"regexp"
@@ -35,9 +40,25 @@ type HTTPStaticServer struct {
 	PlistProxy      string
 	GoogleTrackerId string
 	AuthType        string
+	StorageType     string // "", "localfs", "s3" or "b2"
+	Bucket          string
+	Region          string
+	Dedup           bool   // content-addressed storage for uploads, see dedup.go
+	ClamdAddr       string // clamd INSTREAM address, e.g. tcp://host:3310, set via --virustotal-clamd; empty disables scanning
+
+	// indexMu guards indexes and gramIndex: the background goroutine in
+	// NewHTTPStaticServer rebuilds both every 10 minutes while hJSONList's
+	// calls into findIndex read them concurrently from request goroutines.
+	indexMu   sync.RWMutex
+	indexes   []IndexFileItem
+	gramIndex map[string][]int // lowercased path trigram -> indexes into `indexes`
+
+	// dedupMu guards the blob store's stat/rename/refcount sequence in
+	// dedup.go against concurrent uploads or deletes of the same content.
+	dedupMu sync.Mutex
 
-	indexes []IndexFileItem
 	m       *mux.Router
+	storage StorageBackend
 }
 
 func NewHTTPStaticServer(root string) *HTTPStaticServer {
@@ -51,9 +72,10 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 	log.Printf("root path: %s\n", root)
 	m := mux.NewRouter()
 	s := &HTTPStaticServer{
-		Root:  root,
-		Theme: "black",
-		m:     m,
+		Root:    root,
+		Theme:   "black",
+		m:       m,
+		storage: newLocalFSBackend(root),
 	}
 
 	go func() {
@@ -63,6 +85,8 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 			log.Println("Started making search index")
 			s.makeIndex()
 			log.Printf("Completed search index in %v", time.Since(startTime))
+			s.gcPartialUploads()
+			s.gcExpiredUploads()
 			//time.Sleep(time.Second * 1)
 			time.Sleep(time.Minute * 10)
 		}
@@ -71,6 +95,8 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 	m.HandleFunc("/-/status", s.hStatus)
 	m.HandleFunc("/-/zip/{path:.*}", s.hZip)
 	m.HandleFunc("/-/unzip/{zip_path:.*}/-/{path:.*}", s.hUnzip)
+	m.HandleFunc("/-/tar/{path:.*}", s.hTar)
+	m.HandleFunc("/-/tgz/{path:.*}", s.hTgz)
 	m.HandleFunc("/-/json/{path:.*}", s.hJSONList)
 	// routers for Apple *.ipa
 	m.HandleFunc("/-/ipa/plist/{path:.*}", s.hPlist)
@@ -80,31 +106,105 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 	// TODO: /ipa/info
 	m.HandleFunc("/-/info/{path:.*}", s.hInfo)
 
+	// resumable/chunked upload, tus.io-style
+	m.HandleFunc("/-/upload/{id}", s.hUploadChunkHead).Methods("HEAD")
+	m.HandleFunc("/-/upload/{id}", s.hUploadChunk).Methods("POST", "PATCH")
+
 	m.HandleFunc("/{path:.*}", s.hIndex).Methods("GET", "HEAD")
 	m.HandleFunc("/{path:.*}", s.hUpload).Methods("POST")
 	m.HandleFunc("/{path:.*}", s.hDelete).Methods("DELETE")
 	return s
 }
 
+// UseStorageBackend swaps the server's storage layer for the one configured
+// by the --storage-type/--bucket/--region flags. Called once from main after
+// flag parsing; a zero-value/"localfs" StorageType is a no-op since
+// NewHTTPStaticServer already wired up a local backend.
+func (s *HTTPStaticServer) UseStorageBackend() error {
+	if s.localFSOnly() {
+		return nil
+	}
+	backend, err := newStorageBackend(s.StorageType, s.Root, s.Bucket, s.Region)
+	if err != nil {
+		return err
+	}
+	s.storage = backend
+	if s.Dedup {
+		return fmt.Errorf("--dedup requires a localfs storage backend (got --storage-type=%s): its blob store is written straight to s.Root via os/ioutil, not through StorageBackend", s.StorageType)
+	}
+	if s.ClamdAddr != "" {
+		return fmt.Errorf("--virustotal-clamd requires a localfs storage backend (got --storage-type=%s): its quarantine directory is written straight to s.Root via os/ioutil, not through StorageBackend", s.StorageType)
+	}
+	return nil
+}
+
+// localFSOnly reports whether the server is backed by the default local
+// filesystem backend. Chunked/resumable uploads, expiring-upload metadata,
+// content-addressed dedup and clamd quarantine scanning all write their
+// bookkeeping sidecars straight to filepath.Join(s.Root, ...) via os/ioutil
+// rather than through StorageBackend, so they only work when s.Root names
+// a real local directory; see chunkupload.go, expiringupload.go, dedup.go
+// and clamav.go. The zip handlers and the apk/ipa/plist info routes below
+// have the same restriction: they still read straight off disk via
+// filepath.Join(s.Root, path) instead of s.storage.
+func (s *HTTPStaticServer) localFSOnly() bool {
+	return s.StorageType == "" || s.StorageType == "localfs"
+}
+
 func (s *HTTPStaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
 func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
-	relPath := filepath.Join(s.Root, path)
+	info, statErr := s.storage.Stat(path)
+	if statErr != nil && s.Dedup {
+		// a dedup upload stored as a pointer file has nothing at path
+		// itself; stat the blob the pointer names instead
+		info, statErr = os.Stat(s.resolveBlob(path))
+	}
+	isDir := statErr == nil && info.IsDir()
 
-	if r.FormValue("raw") == "false" || isDir(relPath) {
+	if statErr == nil && !isDir && s.isExpired(path) {
+		http.Error(w, "This file has expired", http.StatusGone)
+		return
+	}
+
+	if r.FormValue("raw") == "false" || isDir {
 		if r.Method == "HEAD" {
 			return
 		}
 		tmpl.ExecuteTemplate(w, "index", s)
+		return
+	}
+	if statErr != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.FormValue("download") == "true" {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	s.consumeDownload(path)
+	var f io.ReadCloser
+	var err error
+	if s.Dedup {
+		f, err = os.Open(s.resolveBlob(path))
 	} else {
-		if r.FormValue("download") == "true" {
-			w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
-		}
-		http.ServeFile(w, r, relPath)
+		f, err = s.storage.Open(path)
 	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	ctype := mime.TypeByExtension(filepath.Ext(path))
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	io.Copy(w, f)
 }
 
 func (s *HTTPStaticServer) hStatus(w http.ResponseWriter, r *http.Request) {
@@ -118,15 +218,26 @@ func (s *HTTPStaticServer) hDelete(w http.ResponseWriter, req *http.Request) {
 	path := mux.Vars(req)["path"]
 	auth := s.readAccessConf(path)
 	log.Printf("%#v", auth)
+
+	// anonymous uploaders can remove their own file by presenting the
+	// delete_key handed back at upload time, without needing a session
 	if !auth.canDelete(req) {
-		http.Error(w, "Delete forbidden", http.StatusForbidden)
-		return
+		meta, err := s.readUploadMeta(path)
+		if err != nil || req.Header.Get("X-Delete-Key") == "" || meta.DeleteKey != req.Header.Get("X-Delete-Key") {
+			http.Error(w, "Delete forbidden", http.StatusForbidden)
+			return
+		}
 	}
-	err := os.Remove(filepath.Join(s.Root, path))
-	if err != nil {
+	if s.Dedup {
+		if err := s.unlinkBlob(path); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else if err := s.storage.Remove(path); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	s.removeUploadMeta(path)
 	w.Write([]byte("Success"))
 }
 
@@ -150,7 +261,11 @@ func (s *HTTPStaticServer) hUpload(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	dirpath := filepath.Join(s.Root, path)
+	type uploadResult struct {
+		URL       string `json:"url"`
+		DeleteKey string `json:"delete_key,omitempty"`
+	}
+	results := make([]uploadResult, 0, len(req.MultipartForm.File["file"]))
 
 	for _, mfile := range req.MultipartForm.File["file"] {
 		file, err := mfile.Open()
@@ -159,21 +274,94 @@ func (s *HTTPStaticServer) hUpload(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		dst, err := os.Create(filepath.Join(dirpath, mfile.Filename)) // BUG(ssx): There is a leak here
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		filename := mfile.Filename
+		if req.FormValue("randomize-name") == "true" {
+			filename = randomizeFilename(filename)
 		}
-		defer dst.Close()
-		if _, err := io.Copy(dst, file); err != nil {
-			log.Println("Handle upload file:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		destPath := filepath.Join(path, filename)
+
+		// when clamd scanning is enabled, the body is first buffered in a
+		// quarantine temp file (teed through the INSTREAM session as it's
+		// written) so nothing becomes visible at destPath until a clean
+		// verdict comes back; src is swapped to read that quarantined copy
+		// before any of the write paths below touch destPath
+		var src io.Reader = file
+		scanned := false
+		if s.ClamdAddr != "" {
+			quarantined, err := s.scanUpload(file)
+			if err != nil {
+				if _, infected := err.(*infectedUploadError); infected {
+					http.Error(w, err.Error(), 422)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer quarantined.Close()
+			src = quarantined
+			scanned = true
 		}
+
+		var sum [sha256.Size]byte
+		if s.Dedup {
+			hash, err := s.writeDedupBlob(src)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := s.linkToBlob(destPath, hash); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			decoded, _ := hex.DecodeString(hash)
+			copy(sum[:], decoded)
+		} else {
+			dst, err := s.storage.Create(destPath) // BUG(ssx): There is a leak here
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer dst.Close()
+			h := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+				log.Println("Handle upload file:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			copy(sum[:], h.Sum(nil))
+		}
+
+		if scanned {
+			if err := s.writeScanVerdict(destPath, &scanVerdict{ScannedAt: time.Now()}); err != nil {
+				log.Println("Write scan verdict:", err)
+			}
+		}
+
+		deleteKey, err := s.registerUploadMeta(req, destPath, sum)
+		if err != nil {
+			log.Println("Register upload metadata:", err)
+		}
+		results = append(results, uploadResult{URL: "/" + destPath, DeleteKey: deleteKey})
+	}
+
+	if req.FormValue("max-days") != "" || req.FormValue("max-downloads") != "" || req.FormValue("randomize-name") == "true" {
+		data, _ := json.Marshal(results)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
 	}
 	w.Write([]byte("Upload success"))
 }
 
+// randomizeFilename keeps name's extension but replaces its basename with a
+// random token, so expiring/anonymous uploads don't collide or leak the
+// original filename.
+func randomizeFilename(name string) string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf) + filepath.Ext(name)
+}
+
 type FileJSONInfo struct {
 	Name    string `json:"name"`
 	Type    string `json:"type"`
@@ -183,6 +371,10 @@ type FileJSONInfo struct {
 }
 
 func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.localFSOnly() {
+		http.Error(w, "File info requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
 	path := mux.Vars(r)["path"]
 	relPath := filepath.Join(s.Root, path)
 	if !isFile(relPath) {
@@ -211,6 +403,10 @@ func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPStaticServer) hInfoApk(w http.ResponseWriter, r *http.Request) {
+	if !s.localFSOnly() {
+		http.Error(w, "Apk info requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
 	path := mux.Vars(r)["path"]
 	relPath := filepath.Join(s.Root, path)
 	if !isFile(relPath) {
@@ -231,11 +427,19 @@ func (s *HTTPStaticServer) hInfoApk(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPStaticServer) hZip(w http.ResponseWriter, r *http.Request) {
+	if !s.localFSOnly() {
+		http.Error(w, "Zip requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
 	path := mux.Vars(r)["path"]
 	CompressToZip(w, filepath.Join(s.Root, path))
 }
 
 func (s *HTTPStaticServer) hUnzip(w http.ResponseWriter, r *http.Request) {
+	if !s.localFSOnly() {
+		http.Error(w, "Unzip requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
 	vars := mux.Vars(r)
 	zipPath, path := vars["zip_path"], vars["path"]
 	ctype := mime.TypeByExtension(filepath.Ext(path))
@@ -262,6 +466,10 @@ func genURLStr(r *http.Request, path string) *url.URL {
 }
 
 func (s *HTTPStaticServer) hPlist(w http.ResponseWriter, r *http.Request) {
+	if !s.localFSOnly() {
+		http.Error(w, "Ipa plist requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
 	path := mux.Vars(r)["path"]
 	// rename *.plist to *.ipa
 	if filepath.Ext(path) == ".plist" {
@@ -293,6 +501,10 @@ func (s *HTTPStaticServer) hPlist(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPStaticServer) hIpaLink(w http.ResponseWriter, r *http.Request) {
+	if !s.localFSOnly() {
+		http.Error(w, "Ipa link requires a localfs storage backend", http.StatusNotImplemented)
+		return
+	}
 	path := mux.Vars(r)["path"]
 	plistUrl := genURLStr(r, "/-/ipa/plist/"+path).String()
 	if r.TLS == nil {
@@ -351,11 +563,13 @@ func (s *HTTPStaticServer) hFileOrDirectory(w http.ResponseWriter, r *http.Reque
 }
 
 type HTTPFileInfo struct {
-	Name    string `json:"name"`
-	Path    string `json:"path"`
-	Type    string `json:"type"`
-	Size    int64  `json:"size"`
-	ModTime int64  `json:"mtime"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"`
+	Scanned  bool   `json:"scanned,omitempty"`
+	Infected bool   `json:"infected,omitempty"`
 }
 
 type AccessTable struct {
@@ -435,7 +649,6 @@ func (c *AccessConf) canUpload(r *http.Request) bool {
 
 func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 	requestPath := mux.Vars(r)["path"]
-	localPath := filepath.Join(s.Root, requestPath)
 	search := r.FormValue("search")
 	auth := s.readAccessConf(requestPath)
 	auth.Upload = auth.canUpload(r)
@@ -446,8 +659,8 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 
 	if search != "" {
 		results := s.findIndex(search)
-		if len(results) > 50 { // max 50
-			results = results[:50]
+		if len(results) > maxSearchResults {
+			results = results[:maxSearchResults]
 		}
 		for _, item := range results {
 			if filepath.HasPrefix(item.Path, requestPath) {
@@ -455,7 +668,7 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	} else {
-		infos, err := ioutil.ReadDir(localPath)
+		infos, err := s.storage.ReadDir(requestPath)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -471,6 +684,9 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 		if !auth.canAccess(info.Name()) {
 			continue
 		}
+		if !info.IsDir() && s.isExpired(path) {
+			continue
+		}
 		lr := HTTPFileInfo{
 			Name:    info.Name(),
 			Path:    path,
@@ -484,7 +700,7 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 			lr.Name = filepath.ToSlash(name) // fix for windows
 		}
 		if info.IsDir() {
-			name := deepPath(localPath, info.Name())
+			name := s.deepPath(requestPath, info.Name())
 			lr.Name = name
 			lr.Path = filepath.Join(filepath.Dir(path), name)
 			lr.Type = "dir"
@@ -492,6 +708,12 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 		} else {
 			lr.Type = "file"
 			lr.Size = info.Size() // formatSize(info)
+			if s.ClamdAddr != "" {
+				if verdict, err := s.readScanVerdict(path); err == nil {
+					lr.Scanned = true
+					lr.Infected = verdict.Infected
+				}
+			}
 		}
 		lrs = append(lrs, lr)
 	}
@@ -504,9 +726,13 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// maxSearchResults caps how many hits hJSONList hands back for a search
+// query; findIndex stops collecting once it has this many.
+const maxSearchResults = 50
+
 func (s *HTTPStaticServer) makeIndex() error {
 	var indexes = make([]IndexFileItem, 0)
-	var err = filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+	var err = s.storage.Walk(".", func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("WARN: Visit path: %s error: %v", strconv.Quote(path), err)
 			return filepath.SkipDir
@@ -516,36 +742,172 @@ func (s *HTTPStaticServer) makeIndex() error {
 			return nil
 		}
 
-		path, _ = filepath.Rel(s.Root, path)
-		path = filepath.ToSlash(path)
+		// StorageBackend.Walk already hands back a slash-separated path
+		// relative to its own root; re-deriving that from s.Root here
+		// only works by accident for localfs and breaks for s3/b2, whose
+		// Walk yields bucket-relative keys with no relation to s.Root.
 		indexes = append(indexes, IndexFileItem{path, info})
 		return nil
 	})
+	gramIndex := buildGramIndex(indexes)
+
+	s.indexMu.Lock()
 	s.indexes = indexes
+	s.gramIndex = gramIndex
+	s.indexMu.Unlock()
 	return err
 }
 
+// gramSize is the shingle length the search index is built from. Trigrams
+// are the standard choice for substring-search indexes (as in Russ Cox's
+// codesearch): short enough that any keyword of 3+ chars decomposes into
+// grams the index can look up, long enough to keep gram->file fan-out low.
+const gramSize = 3
+
+// pathGrams returns every overlapping gramSize-byte shingle of the
+// lowercased path, e.g. "bar.txt" -> "bar", "ar.", "r.t", ".tx", "txt".
+func pathGrams(path string) []string {
+	path = strings.ToLower(path)
+	if len(path) < gramSize {
+		return nil
+	}
+	grams := make([]string, 0, len(path)-gramSize+1)
+	for i := 0; i+gramSize <= len(path); i++ {
+		grams = append(grams, path[i:i+gramSize])
+	}
+	return grams
+}
+
+// buildGramIndex maps every trigram appearing in an indexed path to the
+// list of positions in indexes it occurs in, so matchKeyword can look a
+// search term up directly instead of scanning every file for it.
+func buildGramIndex(indexes []IndexFileItem) map[string][]int {
+	gramIndex := make(map[string][]int)
+	for i, item := range indexes {
+		seen := make(map[string]bool)
+		for _, g := range pathGrams(item.Path) {
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+			gramIndex[g] = append(gramIndex[g], i)
+		}
+	}
+	return gramIndex
+}
+
+// matchKeyword returns the set of s.indexes positions whose path contains
+// keyword (already lowercased). It narrows candidates via the gram index
+// first, then confirms each one with a real substring check, since sharing
+// every trigram of keyword doesn't by itself prove they're contiguous.
+// Keywords shorter than a gram can't be looked up this way and fall back
+// to a direct scan. Caller must hold s.indexMu for reading.
+func (s *HTTPStaticServer) matchKeyword(keyword string) map[int]bool {
+	matched := make(map[int]bool)
+	grams := pathGrams(keyword)
+	if len(grams) == 0 {
+		for i, item := range s.indexes {
+			if strings.Contains(strings.ToLower(item.Path), keyword) {
+				matched[i] = true
+			}
+		}
+		return matched
+	}
+
+	var candidates map[int]bool
+	for _, g := range grams {
+		ids := s.gramIndex[g]
+		next := make(map[int]bool, len(ids))
+		for _, id := range ids {
+			if candidates == nil || candidates[id] {
+				next[id] = true
+			}
+		}
+		candidates = next
+		if len(candidates) == 0 {
+			return matched
+		}
+	}
+	for id := range candidates {
+		if strings.Contains(strings.ToLower(s.indexes[id].Path), keyword) {
+			matched[id] = true
+		}
+	}
+	return matched
+}
+
 func (s *HTTPStaticServer) findIndex(text string) []IndexFileItem {
-	ret := make([]IndexFileItem, 0)
-	for _, item := range s.indexes {
-		ok := true
-		// search algorithm, space for AND
-		for _, keyword := range strings.Fields(text) {
-			needContains := true
-			if strings.HasPrefix(keyword, "-") {
-				needContains = false
-				keyword = keyword[1:]
+	s.indexMu.RLock()
+	defer s.indexMu.RUnlock()
+
+	var candidates map[int]bool // nil means "everything matches so far"
+	// search algorithm, space for AND
+	for _, keyword := range strings.Fields(text) {
+		needContains := true
+		if strings.HasPrefix(keyword, "-") {
+			needContains = false
+			keyword = keyword[1:]
+		}
+		if keyword == "" {
+			continue
+		}
+		keyword = strings.ToLower(keyword)
+
+		var matched map[int]bool
+		if candidates != nil && len(candidates) < maxSearchResults {
+			// the candidate set is already small: testing each one
+			// directly is cheaper than another full gram-index lookup
+			matched = make(map[int]bool, len(candidates))
+			for id := range candidates {
+				if strings.Contains(strings.ToLower(s.indexes[id].Path), keyword) {
+					matched[id] = true
+				}
 			}
-			if keyword == "" {
-				continue
+		} else {
+			matched = s.matchKeyword(keyword)
+		}
+
+		var next map[int]bool
+		switch {
+		case needContains && candidates == nil:
+			next = matched
+		case needContains:
+			// intersect candidates with matched, walking whichever is smaller
+			small, big := candidates, matched
+			if len(matched) < len(candidates) {
+				small, big = matched, candidates
 			}
-			ok = (needContains == strings.Contains(strings.ToLower(item.Path), strings.ToLower(keyword)))
-			if !ok {
-				break
+			next = make(map[int]bool, len(small))
+			for id := range small {
+				if big[id] {
+					next[id] = true
+				}
+			}
+		case candidates == nil:
+			next = make(map[int]bool, len(s.indexes))
+			for i := range s.indexes {
+				if !matched[i] {
+					next[i] = true
+				}
+			}
+		default:
+			next = make(map[int]bool, len(candidates))
+			for id := range candidates {
+				if !matched[id] {
+					next[id] = true
+				}
 			}
 		}
-		if ok {
+		candidates = next
+	}
+
+	ret := make([]IndexFileItem, 0)
+	for i, item := range s.indexes {
+		if candidates == nil || candidates[i] {
 			ret = append(ret, item)
+			if len(ret) >= maxSearchResults {
+				break
+			}
 		}
 	}
 	return ret
@@ -565,17 +927,24 @@ func (s *HTTPStaticServer) readAccessConf(requestPath string) (ac AccessConf) {
 		parentPath := filepath.Dir(requestPath)
 		ac = s.readAccessConf(parentPath)
 	}
-	relPath := filepath.Join(s.Root, requestPath)
-	if isFile(relPath) {
-		relPath = filepath.Dir(relPath)
+	cfgPath := requestPath
+	if info, err := s.storage.Stat(cfgPath); err == nil && !info.IsDir() {
+		cfgPath = filepath.Dir(cfgPath)
 	}
-	cfgFile := filepath.Join(relPath, ".ghs.yml")
-	data, err := ioutil.ReadFile(cfgFile)
+	cfgFile := filepath.Join(cfgPath, ".ghs.yml")
+	f, err := s.storage.Open(cfgFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return
 		}
 		log.Printf("Err read .ghs.yml: %v", err)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Printf("Err read .ghs.yml: %v", err)
+		return
 	}
 	err = yaml.Unmarshal(data, &ac)
 	if err != nil {
@@ -584,12 +953,12 @@ func (s *HTTPStaticServer) readAccessConf(requestPath string) (ac AccessConf) {
 	return
 }
 
-func deepPath(basedir, name string) string {
+func (s *HTTPStaticServer) deepPath(basedir, name string) string {
 	isDir := true
 	// loop max 5, incase of for loop not finished
 	maxDepth := 5
 	for depth := 0; depth <= maxDepth && isDir; depth += 1 {
-		finfos, err := ioutil.ReadDir(filepath.Join(basedir, name))
+		finfos, err := s.storage.ReadDir(filepath.Join(basedir, name))
 		if err != nil || len(finfos) != 1 {
 			break
 		}
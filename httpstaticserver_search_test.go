@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func newTestIndex(paths ...string) *HTTPStaticServer {
+	indexes := make([]IndexFileItem, len(paths))
+	for i, p := range paths {
+		indexes[i] = IndexFileItem{Path: p}
+	}
+	return &HTTPStaticServer{
+		indexes:   indexes,
+		gramIndex: buildGramIndex(indexes),
+	}
+}
+
+func pathsOf(s *HTTPStaticServer, ids map[int]bool) []string {
+	out := make([]string, 0, len(ids))
+	for id := range ids {
+		out = append(out, s.indexes[id].Path)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestMatchKeyword(t *testing.T) {
+	s := newTestIndex("foo/bar.txt", "foo/baz.txt", "qux/bar.go")
+
+	got := pathsOf(s, s.matchKeyword("bar"))
+	want := []string{"foo/bar.txt", "qux/bar.go"}
+	if !equalStrings(got, want) {
+		t.Fatalf("matchKeyword(bar) = %v, want %v", got, want)
+	}
+
+	got = pathsOf(s, s.matchKeyword(".txt"))
+	want = []string{"foo/bar.txt", "foo/baz.txt"}
+	if !equalStrings(got, want) {
+		t.Fatalf("matchKeyword(.txt) = %v, want %v", got, want)
+	}
+
+	if got := s.matchKeyword("nope"); len(got) != 0 {
+		t.Fatalf("matchKeyword(nope) = %v, want empty", got)
+	}
+}
+
+func TestMatchKeywordShorterThanGram(t *testing.T) {
+	// keywords under gramSize bytes can't be looked up via the trigram
+	// index and must fall back to a direct per-path scan.
+	s := newTestIndex("ab.txt", "cd.txt")
+
+	got := pathsOf(s, s.matchKeyword("ab"))
+	want := []string{"ab.txt"}
+	if !equalStrings(got, want) {
+		t.Fatalf("matchKeyword(ab) = %v, want %v", got, want)
+	}
+}
+
+func TestFindIndexAndNot(t *testing.T) {
+	s := newTestIndex("foo/bar.txt", "foo/baz.txt", "qux/bar.go")
+
+	// AND: both keywords must match the same path
+	got := findIndexPaths(s, "foo bar")
+	want := []string{"foo/bar.txt"}
+	if !equalStrings(got, want) {
+		t.Fatalf("findIndex(foo bar) = %v, want %v", got, want)
+	}
+
+	// NOT: leading "-" excludes matches
+	got = findIndexPaths(s, "bar -qux")
+	want = []string{"foo/bar.txt"}
+	if !equalStrings(got, want) {
+		t.Fatalf("findIndex(bar -qux) = %v, want %v", got, want)
+	}
+}
+
+func findIndexPaths(s *HTTPStaticServer, text string) []string {
+	items := s.findIndex(text)
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[i] = item.Path
+	}
+	sort.Strings(out)
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localFSBackend is the default StorageBackend, rooted at a directory on
+// local disk. It preserves the server's original os.*/ioutil.* behavior.
+type localFSBackend struct {
+	root string
+}
+
+func newLocalFSBackend(root string) *localFSBackend {
+	return &localFSBackend{root: root}
+}
+
+func (b *localFSBackend) abs(path string) string {
+	return filepath.Join(b.root, path)
+}
+
+func (b *localFSBackend) Open(path string) (io.ReadCloser, error) {
+	return os.Open(b.abs(path))
+}
+
+func (b *localFSBackend) Create(path string) (io.WriteCloser, error) {
+	return os.Create(b.abs(path))
+}
+
+func (b *localFSBackend) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(b.abs(path))
+}
+
+func (b *localFSBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(b.abs(path))
+}
+
+func (b *localFSBackend) Remove(path string) error {
+	return os.Remove(b.abs(path))
+}
+
+func (b *localFSBackend) Rename(oldpath, newpath string) error {
+	return os.Rename(b.abs(oldpath), b.abs(newpath))
+}
+
+// Walk satisfies the StorageBackend contract of handing walkFn
+// slash-separated paths relative to the backend's own root, even though
+// filepath.Walk itself only knows about the absolute disk path it was
+// given.
+func (b *localFSBackend) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(b.abs(root), func(path string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(b.root, path)
+		if relErr != nil {
+			return walkFn(path, info, relErr)
+		}
+		return walkFn(filepath.ToSlash(rel), info, err)
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// objectFileInfo implements os.FileInfo for backends (s3, b2) whose
+// directory listings come back as API objects rather than syscall stat
+// results.
+type objectFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func newObjectFileInfo(name string, size int64, mtime time.Time, dir bool) *objectFileInfo {
+	return &objectFileInfo{name: name, size: size, mtime: mtime, dir: dir}
+}
+
+func (fi *objectFileInfo) Name() string       { return fi.name }
+func (fi *objectFileInfo) Size() int64        { return fi.size }
+func (fi *objectFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *objectFileInfo) Sys() interface{}   { return nil }
+
+func (fi *objectFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *objectFileInfo) IsDir() bool { return fi.dir }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Backend is a StorageBackend that streams GETs and PUTs straight to an S3
+// bucket, so gohttpserver can front a bucket without a local disk.
+type s3Backend struct {
+	bucket     string
+	client     *s3.S3
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+func newS3Backend(bucket, region string) (*s3Backend, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{
+		bucket:     bucket,
+		client:     s3.New(sess),
+		uploader:   s3manager.NewUploader(sess),
+		downloader: s3manager.NewDownloader(sess),
+	}, nil
+}
+
+// key turns a StorageBackend-style relative path into an S3 object key,
+// collapsing the "." that Walk(".", ...) passes for "the whole bucket"
+// down to an empty prefix rather than a literal no-match ".".
+func (b *s3Backend) key(path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if path == "." {
+		return ""
+	}
+	return path
+}
+
+func (b *s3Backend) Open(path string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(path)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Create returns an s3Writer that streams each write to S3 through the
+// managed multipart uploader as it arrives, so large uploads go out in parts
+// rather than being held entirely in memory; its Close waits for the upload
+// to finish.
+func (b *s3Backend) Create(path string) (io.WriteCloser, error) {
+	return newS3Writer(b, b.key(path)), nil
+}
+
+func (b *s3Backend) Stat(path string) (os.FileInfo, error) {
+	out, err := b.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(path)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newObjectFileInfo(filepath.Base(path), aws.Int64Value(out.ContentLength), aws.TimeValue(out.LastModified), false), nil
+}
+
+func (b *s3Backend) ReadDir(path string) ([]os.FileInfo, error) {
+	prefix := b.key(path)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	out, err := b.client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(b.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(out.Contents)+len(out.CommonPrefixes))
+	for _, p := range out.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/")
+		infos = append(infos, newObjectFileInfo(name, 0, time.Time{}, true))
+	}
+	for _, obj := range out.Contents {
+		name := strings.TrimPrefix(aws.StringValue(obj.Key), prefix)
+		if name == "" {
+			continue
+		}
+		infos = append(infos, newObjectFileInfo(name, aws.Int64Value(obj.Size), aws.TimeValue(obj.LastModified), false))
+	}
+	return infos, nil
+}
+
+func (b *s3Backend) Remove(path string) error {
+	_, err := b.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(path)),
+	})
+	return err
+}
+
+func (b *s3Backend) Rename(oldpath, newpath string) error {
+	_, err := b.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		CopySource: aws.String(b.bucket + "/" + b.key(oldpath)),
+		Key:        aws.String(b.key(newpath)),
+	})
+	if err != nil {
+		return err
+	}
+	return b.Remove(oldpath)
+}
+
+// Walk lists every object under root and invokes walkFn for each one, like
+// filepath.Walk but backed by repeated ListObjectsV2 calls.
+func (b *s3Backend) Walk(root string, walkFn filepath.WalkFunc) error {
+	prefix := b.key(root)
+	return b.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			name := aws.StringValue(obj.Key)
+			info := newObjectFileInfo(filepath.Base(name), aws.Int64Value(obj.Size), aws.TimeValue(obj.LastModified), false)
+			if err := walkFn(name, info, nil); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+}
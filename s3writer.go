@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Writer streams writes through an io.Pipe straight into
+// s3manager.Uploader.Upload, which itself splits the stream into multipart
+// PUTs. This lets hUpload keep writing through a plain io.WriteCloser, the
+// same as it does for the localfs backend, without ever holding a whole
+// multi-GB object in memory first.
+type s3Writer struct {
+	pw     *io.PipeWriter
+	result chan error
+}
+
+func newS3Writer(backend *s3Backend, key string) *s3Writer {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, result: make(chan error, 1)}
+	go func() {
+		_, err := backend.uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		w.result <- err
+	}()
+	return w
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close tells the uploader there's no more data and waits for the
+// multipart upload to finish, surfacing any upload error the way a flush
+// error would surface from os.File.Close.
+func (w *s3Writer) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.result
+}
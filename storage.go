@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// StorageBackend abstracts the file operations HTTPStaticServer needs in
+// order to serve, list and mutate a tree of files. Implementations let the
+// same handlers (hUpload, hDelete, hIndex, hJSONList, makeIndex,
+// readAccessConf) work against a local disk, or a remote bucket such as S3
+// or B2, without knowing which one is behind the interface.
+//
+// Paths passed to a StorageBackend are always slash-separated and relative
+// to the backend's own root; callers should not join them with s.Root.
+type StorageBackend interface {
+	Open(path string) (io.ReadCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Remove(path string) error
+	Rename(oldpath, newpath string) error
+	Walk(root string, walkFn filepath.WalkFunc) error
+}
+
+// newStorageBackend builds the StorageBackend selected by storageType,
+// defaulting to the local filesystem rooted at root. storageType, bucket and
+// region come from CLI flags / environment variables (--storage-type,
+// --bucket, --region) wired up in main.
+func newStorageBackend(storageType, root, bucket, region string) (StorageBackend, error) {
+	switch storageType {
+	case "", "localfs":
+		return newLocalFSBackend(root), nil
+	case "s3":
+		return newS3Backend(bucket, region)
+	case "b2":
+		return newB2Backend(bucket)
+	default:
+		return nil, errUnknownStorageType(storageType)
+	}
+}
+
+type errUnknownStorageType string
+
+func (e errUnknownStorageType) Error() string {
+	return "unknown storage type: " + string(e)
+}